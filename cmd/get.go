@@ -15,9 +15,14 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Unknwon/com"
 	"github.com/Unknwon/goconfig"
@@ -52,36 +57,65 @@ then all the packages go into gopm local repository.`,
 		cli.BoolFlag{"gopath, g", "download all pakcages to GOPATH"},
 		cli.BoolFlag{"remote, r", "download all pakcages to gopm local repository"},
 		cli.BoolFlag{"verbose, v", "show process details"},
+		cli.IntFlag{"jobs, j", runtime.NumCPU(), "number of concurrent download workers"},
+		cli.BoolFlag{"t", "fetch dependencies needed only by _test.go files as well"},
+		cli.BoolFlag{"insecure", "skip gopm.sum verification and allow insecure downloads"},
+		cli.BoolFlag{"update-sum", "recompute and refresh gopm.sum entries instead of verifying them"},
+		cli.BoolFlag{"fix", "run go tool fix over a package before resolving its imports"},
 	},
 }
 
 var (
-	// Saves packages that have been downloaded.
-	// NOTE: need a safe map for future downloading packages concurrency.
-	downloadCache = make(map[string]bool)
-	skipCache     = make(map[string]bool)
-	downloadCount int
-	failConut     int
+	downloadCount int64
+	failConut     int64
 )
 
+// logLine is a single buffered log call, replayed once its owning node
+// finishes so that output for a root package stays together even when
+// multiple workers are downloading concurrently.
+type logLine func()
+
+// nodeLog collects log lines for a single node and flushes them in order.
+type nodeLog struct {
+	lines []logLine
+}
+
+func (nl *nodeLog) add(fn logLine) {
+	nl.lines = append(nl.lines, fn)
+}
+
+func (nl *nodeLog) flush() {
+	for _, fn := range nl.lines {
+		fn()
+	}
+}
+
 // downloadPackage downloads package either use version control tools or not.
-func downloadPackage(ctx *cli.Context, n *doc.Node) (*doc.Node, []string) {
-	log.Message("", "Downloading package: "+n.VerString())
-	downloadCache[n.RootPath] = true
+// downloadPackage fetches n and returns the imports found under its
+// installed tree. When '-t' is set, testImports holds the subset of
+// imports pulled in only by _test.go files, i.e. those missing from the
+// package's non-test import set, so callers never have to record the same
+// dependency in both [deps] and [deps.test].
+func downloadPackage(ctx *cli.Context, n *doc.Node, nl *nodeLog) (node *doc.Node, imports []string, testImports []string) {
+	nl.add(func() { log.Message("", "Downloading package: "+n.VerString()) })
 
-	var imports []string
 	var err error
+	// Whether dependencies pulled in only by _test.go files should be fetched too.
+	includeTests := ctx.Bool("t")
 	// Check if only need to use VCS tools.
 	vcs := doc.GetVcsName(n.InstallGopath)
 	// If update, gopath and VCS tools set,
 	// then use VCS tools to update the package.
-	if ctx.Bool("update") && (ctx.Bool("gopath") || ctx.Bool("local")) && len(vcs) > 0 {
+	usedVcsUpdate := ctx.Bool("update") && (ctx.Bool("gopath") || ctx.Bool("local")) && len(vcs) > 0
+	dir := n.InstallPath
+	if usedVcsUpdate {
+		dir = n.InstallGopath
 		err = n.UpdateByVcs(vcs)
-		imports = doc.GetImports(n.ImportPath, n.RootPath, n.InstallGopath, false)
+		imports = doc.GetImports(n.ImportPath, n.RootPath, dir, includeTests)
 	} else {
 		// IsGetDepsOnly promises package is fixed version and exists in local repository.
 		if n.IsGetDepsOnly {
-			imports = doc.GetImports(n.ImportPath, n.RootPath, n.InstallPath, false)
+			imports = doc.GetImports(n.ImportPath, n.RootPath, dir, includeTests)
 		} else {
 			// Get revision value from local records.
 			if n.IsExist() {
@@ -92,125 +126,399 @@ func downloadPackage(ctx *cli.Context, n *doc.Node) (*doc.Node, []string) {
 	}
 
 	if err != nil {
-		log.Error("get", "Fail to download pakage: "+n.ImportPath)
-		log.Error("", "\t"+err.Error())
-		failConut++
+		nl.add(func() { log.Error("get", "Fail to download pakage: "+n.ImportPath) })
+		nl.add(func() { log.Error("", "\t"+err.Error()) })
+		atomic.AddInt64(&failConut, 1)
 		os.RemoveAll(n.InstallPath)
-		return nil, nil
+		return nil, nil, nil
+	}
+
+	// gopm commonly pulls old pinned revisions whose import paths or API
+	// calls have since been renamed upstream; run them through "go tool
+	// fix" before trusting the import set computed above. Fix the same
+	// directory the imports above were just read from.
+	if ctx.Bool("fix") {
+		if err := runFix(dir); err != nil {
+			nl.add(func() { log.Error("get", "Fail to run go tool fix: "+err.Error()) })
+		} else {
+			imports = doc.GetImports(n.ImportPath, n.RootPath, dir, includeTests)
+		}
+	}
+
+	// imports above already includes test-only imports when includeTests
+	// is set; re-read with includeTests forced off to tell the two apart,
+	// so a dependency only ever lands in one of [deps] or [deps.test].
+	if includeTests {
+		normal := doc.GetImports(n.ImportPath, n.RootPath, dir, false)
+		testImports = diffTestImports(imports, normal)
 	}
 
 	if !n.IsGetDeps {
-		imports = nil
+		imports, testImports = nil, nil
 	}
-	return n, imports
+	return n, imports, testImports
 }
 
-// downloadPackages downloads packages with certain commit,
-// if the commit is empty string, then it downloads all dependencies,
-// otherwise, it only downloada package with specific commit only.
-func downloadPackages(target string, ctx *cli.Context, nodes []*doc.Node) {
-	for _, n := range nodes {
-		// Check if it is a valid remote path or C.
-		if n.ImportPath == "C" {
-			continue
-		} else if !doc.IsValidRemotePath(n.ImportPath) {
-			// Invalid import path.
-			log.Error("download", "Skipped invalid package: "+n.VerString())
-			failConut++
-			continue
+// diffTestImports returns the entries of all that are not present in
+// normal, in all's order: the imports pulled in only by _test.go files,
+// once the non-test import set for the same directory is known.
+func diffTestImports(all, normal []string) []string {
+	isNormal := make(map[string]bool, len(normal))
+	for _, name := range normal {
+		isNormal[name] = true
+	}
+	var testOnly []string
+	for _, name := range all {
+		if !isNormal[name] {
+			testOnly = append(testOnly, name)
 		}
+	}
+	return testOnly
+}
 
-		// Valid import path.
-		if isSubpackage(n.RootPath, target) {
-			continue
-		}
+// runFix runs "go tool fix" over the package tree rooted at dir, rewriting
+// API calls renamed since the pinned revision was written so the import
+// set parsed afterwards actually resolves.
+func runFix(dir string) error {
+	out, err := exec.Command("go", "tool", "fix", dir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+	return nil
+}
+
+// discoverNode records the version n was requested at with the resolver,
+// then -- the first time n's RootPath is seen -- fetches it once just to
+// read its gopmfile and enqueue its own dependencies for discovery. It
+// never treats anything it fetches as a final install: installResolved
+// downloads the resolver's winning version separately, once the whole
+// graph has been walked.
+func discoverNode(target string, ctx *cli.Context, n *doc.Node, resolver *doc.Resolver, enqueue func([]*doc.Node), discovered *sync.Map) {
+	nl := new(nodeLog)
+
+	// Check if it is a valid remote path or C.
+	if n.ImportPath == "C" {
+		return
+	} else if !doc.IsValidRemotePath(n.ImportPath) {
+		// Invalid import path.
+		nl.add(func() { log.Error("download", "Skipped invalid package: "+n.VerString()) })
+		nl.flush()
+		atomic.AddInt64(&failConut, 1)
+		return
+	} else if err := doc.CheckRemoteScheme(n.ImportPath, ctx.Bool("insecure")); err != nil {
+		nl.add(func() { log.Error("download", err.Error()) })
+		nl.flush()
+		atomic.AddInt64(&failConut, 1)
+		return
+	}
+
+	// Valid import path.
+	if isSubpackage(n.RootPath, target) {
+		return
+	}
+
+	resolver.Require("", n.RootPath, n.Type, n.Value)
+
+	// A module's gopmfile is read only once, at the version of it that is
+	// reached first; later requirements at other versions are recorded
+	// above, but their own gopmfiles are not read.
+	if _, loaded := discovered.LoadOrStore(n.RootPath, true); loaded {
+		return
+	}
+
+	nod, imports, testImports := downloadPackage(ctx, n, nl)
+	nl.flush()
+	if nod == nil {
+		return
+	}
+
+	var gf *goconfig.ConfigFile
+	gfPath := path.Join(n.InstallPath, setting.GOPMFILE)
+
+	// Check if has gopmfile.
+	if com.IsFile(gfPath) {
+		gf = loadGopmfile(gfPath)
+	}
 
-		// Indicates whether need to download package or update.
-		if n.IsFixed() && n.IsExist() {
-			n.IsGetDepsOnly = true
+	isTestOnly := make(map[string]bool, len(testImports))
+	for _, name := range testImports {
+		isTestOnly[name] = true
+	}
+
+	// Generate temporary nodes purely to walk further; the version each
+	// module actually gets installed at is decided later by the resolver,
+	// from every constraint placed on its RootPath across the whole
+	// graph, not just this occurrence.
+	children := make([]*doc.Node, len(imports))
+	var newTestDeps []string
+	for i, name := range imports {
+		section := "deps"
+		if isTestOnly[name] {
+			section = "deps.test"
 		}
 
-		if downloadCache[n.RootPath] {
-			if !skipCache[n.RootPath] {
-				skipCache[n.RootPath] = true
-				log.Trace("Skipped downloaded package: %s", n.VerString())
+		typ, value := doc.BRANCH, ""
+		if gf != nil {
+			if v := gf.MustValue(section, name); len(v) > 0 {
+				typ, value = validPkgInfo(v)
 			}
+		}
+
+		// children carry the pin read from n's own gopmfile, not a bare
+		// branch tip, so walking further -- when this is the first time a
+		// child is reached -- reads *its* gopmfile at the version n
+		// actually requires -- a pinned version's manifest can
+		// differ from branch HEAD's, which is the whole reason versioning
+		// exists.
+		children[i] = doc.NewNode(name, typ, value, !ctx.Bool("download"))
+		resolver.Require(n.RootPath, children[i].RootPath, typ, value)
+
+		// Record a test-only import gopm has not seen pinned before, so
+		// it lands in [deps.test] instead of requiring the user to hand-
+		// write it there themselves.
+		if section == "deps.test" && len(value) == 0 {
+			newTestDeps = append(newTestDeps, name)
+		}
+	}
+	enqueue(children)
+
+	if len(newTestDeps) > 0 {
+		recordTestDeps(gfPath, newTestDeps)
+	}
+}
+
+// recordTestDeps appends newly discovered test-only imports to the
+// [deps.test] section of the gopmfile at gfPath, creating the file if it
+// does not exist yet, so they no longer have to be added by hand.
+func recordTestDeps(gfPath string, names []string) {
+	gf, err := goconfig.LoadConfigFile(gfPath)
+	if err != nil {
+		gf = goconfig.NewConfigFile()
+	}
+	for _, name := range names {
+		if len(gf.MustValue("deps.test", name)) > 0 {
 			continue
 		}
+		gf.SetValue("deps.test", name, "")
+	}
+	if err := goconfig.SaveConfigFile(gf, gfPath); err != nil {
+		log.Error("get", "Fail to save gopmfile: "+err.Error())
+	}
+}
 
-		if !ctx.Bool("update") {
-			// Check if package has been downloaded.
-			if n.IsExist() {
-				if !skipCache[n.RootPath] {
-					skipCache[n.RootPath] = true
-					log.Trace("Skipped installed package: %s", n.VerString())
-				}
-
-				// Only copy when no version control.
-				if ctx.Bool("gopath") || ctx.Bool("local") {
-					n.CopyToGopath()
-				}
-				continue
-			} else {
-				setting.LocalNodes.SetValue(n.RootPath, "value", "")
-			}
+// discoverConstraints walks the whole dependency graph once with a
+// bounded worker pool (sized by '--jobs, -j'), recording with resolver
+// every version any gopmfile it reads asks for every module it can reach.
+// Nothing it downloads is treated as a final install -- see
+// installResolved.
+func discoverConstraints(target string, ctx *cli.Context, nodes []*doc.Node, resolver *doc.Resolver) {
+	jobs := ctx.Int("jobs")
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	queue := make(chan *doc.Node, 64)
+	var pending sync.WaitGroup
+	var discovered sync.Map
+
+	// Sends happen on their own goroutine: enqueue is called from inside
+	// a worker's own "for n := range queue" loop, so a worker blocked
+	// sending into a full queue would also stop draining it, deadlocking
+	// the whole pool the moment one node's imports outgrow the buffer.
+	enqueue := func(ns []*doc.Node) {
+		if len(ns) == 0 {
+			return
 		}
-		// Download package.
-		nod, imports := downloadPackage(ctx, n)
-		for _, name := range imports {
-			var gf *goconfig.ConfigFile
-			gfPath := path.Join(n.InstallPath, setting.GOPMFILE)
-
-			// Check if has gopmfile.
-			if com.IsFile(gfPath) {
-				log.Log("Found gopmfile: %s", n.VerString())
-				gf = loadGopmfile(gfPath)
+		pending.Add(len(ns))
+		go func() {
+			for _, n := range ns {
+				queue <- n
 			}
+		}()
+	}
 
-			// Need to download dependencies.
-			// Generate temporary nodes.
-			nodes := make([]*doc.Node, len(imports))
-			for i := range nodes {
-				nodes[i] = doc.NewNode(name, doc.BRANCH, "", !ctx.Bool("download"))
+	var workers sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for n := range queue {
+				discoverNode(target, ctx, n, resolver, enqueue, &discovered)
+				pending.Done()
+			}
+		}()
+	}
 
-				if gf == nil {
-					continue
-				}
+	enqueue(nodes)
+	go func() {
+		pending.Wait()
+		close(queue)
+	}()
+	workers.Wait()
+}
 
-				// Check if user specified the version.
-				if v := gf.MustValue("deps", imports[i]); len(v) > 0 {
-					nodes[i].Type, nodes[i].Value = validPkgInfo(v)
-				}
-			}
-			downloadPackages(target, ctx, nodes)
-		}
+// needsInstall reports whether installNode should actually (re)download a
+// resolved module: either '--update' was passed, or nothing is installed
+// at its path yet. Otherwise the existing install is trusted as-is,
+// whichever version was asked for and whether or not '--remote, -r' is set.
+func needsInstall(update, exists bool) bool {
+	return update || !exists
+}
 
-		// Only save package information with specific commit.
-		if nod == nil {
-			continue
+// installNode downloads n -- which already carries the resolver's
+// winning version -- for real, unless it is already installed and
+// '--update' was not passed. Anything discoverConstraints may have left
+// behind for the same module at a different (non-winning) version is not
+// trusted, so when a real download does happen, the install path is
+// wiped first.
+func installNode(ctx *cli.Context, n *doc.Node, nl *nodeLog, sumDB *doc.SumDB) {
+	if !needsInstall(ctx.Bool("update"), n.IsExist()) {
+		nl.add(func() { log.Trace("Skipped installed package: %s", n.VerString()) })
+		if ctx.Bool("gopath") || ctx.Bool("local") {
+			n.CopyToGopath()
 		}
+		return
+	}
+	if !n.IsExist() {
+		setting.LocalNodes.SetValue(n.RootPath, "value", "")
+	}
 
-		// Save record in local nodes.
-		log.Success("SUCC", "GET", n.VerString())
-		downloadCount++
+	os.RemoveAll(n.InstallPath)
 
-		// Only save non-commit node.
-		if nod.IsEmptyVal() && len(nod.Revision) > 0 {
-			setting.LocalNodes.SetValue(nod.RootPath, "value", nod.Revision)
+	nod, _, _ := downloadPackage(ctx, n, nl)
+	if nod == nil {
+		atomic.AddInt64(&failConut, 1)
+		return
+	}
+
+	// Verify (or, with --update-sum, refresh) the recorded checksum for
+	// this exact version before trusting what was just downloaded.
+	version := nod.Value
+	if len(version) == 0 {
+		version = nod.Revision
+	}
+	if ctx.Bool("update-sum") {
+		if err := sumDB.Update(nod.RootPath, version, n.InstallPath); err != nil {
+			nl.add(func() { log.Error("get", "Fail to update gopm.sum: "+err.Error()) })
+		}
+	} else if !ctx.Bool("insecure") {
+		if err := sumDB.Verify(nod.RootPath, version, n.InstallPath); err != nil {
+			nl.add(func() { log.Error("get", err.Error()) })
+			atomic.AddInt64(&failConut, 1)
+			os.RemoveAll(n.InstallPath)
+			return
 		}
+	}
+
+	// Save record in local nodes.
+	nl.add(func() { log.Success("SUCC", "GET", n.VerString()) })
+	atomic.AddInt64(&downloadCount, 1)
+
+	// Only save non-commit node.
+	if nod.IsEmptyVal() && len(nod.Revision) > 0 {
+		setting.LocalNodes.SetValue(nod.RootPath, "value", nod.Revision)
+	}
 
-		// If update set downloadPackage will use VSC tools to download the package,
-		// else just download to local repository and copy to GOPATH.
-		if (ctx.Bool("gopath") || ctx.Bool("local")) && !nod.HasVcs() {
-			nod.CopyToGopath()
+	// If update set downloadPackage will use VSC tools to download the package,
+	// else just download to local repository and copy to GOPATH.
+	if (ctx.Bool("gopath") || ctx.Bool("local")) && !nod.HasVcs() {
+		nod.CopyToGopath()
+	}
+}
+
+// installResolved downloads exactly the resolver's winning version of
+// each module in nodes, with a bounded worker pool (sized by
+// '--jobs, -j'). Unlike discovery, the full module set is already known,
+// so this never recurses or enqueues further work.
+func installResolved(ctx *cli.Context, nodes []*doc.Node, sumDB *doc.SumDB) {
+	jobs := ctx.Int("jobs")
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	queue := make(chan *doc.Node, len(nodes))
+	for _, n := range nodes {
+		queue <- n
+	}
+	close(queue)
+
+	var workers sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for n := range queue {
+				nl := new(nodeLog)
+				installNode(ctx, n, nl, sumDB)
+				nl.flush()
+			}
+		}()
+	}
+	workers.Wait()
+}
+
+// downloadPackages resolves then downloads packages with certain commit,
+// if the commit is empty string, then it downloads all dependencies,
+// otherwise, it only downloada package with specific commit only.
+//
+// This runs in two phases, following vgo-style minimum-version selection:
+// discoverConstraints first walks the whole dependency graph, without
+// installing anything for good, to learn every version any gopmfile asks
+// for each module; only once that graph is closed does installResolved
+// download the one winning version per module. Each module's gopmfile is
+// read during discovery only at the version of it reached first, so
+// requirements that appear only in another version's gopmfile are not
+// collected; which version is reached first, like the order of requests
+// the resolver cannot rank (see doc.Resolver), can depend on goroutine
+// scheduling.
+func downloadPackages(target string, ctx *cli.Context, nodes []*doc.Node, sumDB *doc.SumDB) {
+	// Configure the shared HTTP client once, before any worker starts
+	// downloading, so every custom-import-path probe for the rest of this
+	// run honors '--insecure' the same way. Archive fetches done by
+	// n.Download do not use this client.
+	doc.SetInsecure(ctx.Bool("insecure"))
+
+	resolver := doc.NewResolver(ctx.GlobalBool("strict"))
+	discoverConstraints(target, ctx, nodes, resolver)
+
+	for _, conflict := range resolver.Conflicts() {
+		log.Error("get", "Version conflict: "+conflict.Error())
+	}
+
+	modules := resolver.Modules()
+	resolved := make([]*doc.Node, 0, len(modules))
+	for _, rootPath := range modules {
+		typ, value, err := resolver.Winner(rootPath)
+		if err != nil {
+			log.Error("get", "Version conflict: "+err.Error())
+			atomic.AddInt64(&failConut, 1)
+			continue
 		}
+		resolved = append(resolved, doc.NewNode(rootPath, typ, value, true))
+	}
+
+	// Non-strict conflicts are only collected by Winner, above.
+	for _, conflict := range resolver.Conflicts() {
+		log.Error("get", "Version conflict: "+conflict.Error())
 	}
+
+	installResolved(ctx, resolved, sumDB)
 }
 
 func getPackages(target string, ctx *cli.Context, nodes []*doc.Node) {
-	downloadPackages(target, ctx, nodes)
+	sumDB, err := doc.LoadSumDB(setting.GOPMSUM)
+	if err != nil {
+		log.Error("get", "Fail to load gopm.sum: "+err.Error())
+		os.Exit(2)
+	}
+
+	downloadPackages(target, ctx, nodes, sumDB)
 	setting.SaveLocalNodes()
 
+	if err := sumDB.Save(); err != nil {
+		log.Error("get", "Fail to save gopm.sum: "+err.Error())
+	}
+
 	log.Log("%d package(s) downloaded, %d failed", downloadCount, failConut)
 	if ctx.GlobalBool("strict") && failConut > 0 {
 		os.Exit(2)
@@ -227,8 +535,13 @@ func getByGopmfile(ctx *cli.Context) {
 		name = doc.GetRootPath(name)
 		n := doc.NewNode(name, doc.BRANCH, "", !ctx.Bool("download"))
 
-		// Check if user specified the version.
-		if v := gf.MustValue("deps", name); len(v) > 0 {
+		// Check if user specified the version, preferring a normal
+		// dependency pin over a test-only one.
+		v := gf.MustValue("deps", name)
+		if len(v) == 0 {
+			v = gf.MustValue("deps.test", name)
+		}
+		if len(v) > 0 {
 			n.Type, n.Value = validPkgInfo(v)
 		}
 		nodes = append(nodes, n)
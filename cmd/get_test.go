@@ -0,0 +1,77 @@
+// Copyright 2014 Unknown
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNeedsInstall(t *testing.T) {
+	cases := []struct {
+		update, exists, want bool
+	}{
+		{update: false, exists: false, want: true},
+		{update: false, exists: true, want: false},
+		{update: true, exists: false, want: true},
+		{update: true, exists: true, want: true},
+	}
+	for _, c := range cases {
+		if got := needsInstall(c.update, c.exists); got != c.want {
+			t.Errorf("needsInstall(%v, %v) = %v, want %v", c.update, c.exists, got, c.want)
+		}
+	}
+}
+
+func TestDiffTestImports(t *testing.T) {
+	cases := []struct {
+		name         string
+		all, normal  []string
+		wantTestOnly []string
+	}{
+		{
+			name:         "no test-only imports",
+			all:          []string{"a", "b"},
+			normal:       []string{"a", "b"},
+			wantTestOnly: nil,
+		},
+		{
+			name:         "one test-only import",
+			all:          []string{"a", "b", "c"},
+			normal:       []string{"a", "b"},
+			wantTestOnly: []string{"c"},
+		},
+		{
+			name:         "preserves all's order",
+			all:          []string{"c", "a", "b"},
+			normal:       []string{"a"},
+			wantTestOnly: []string{"c", "b"},
+		},
+		{
+			name:         "empty normal set",
+			all:          []string{"a"},
+			normal:       nil,
+			wantTestOnly: []string{"a"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := diffTestImports(c.all, c.normal)
+			if !reflect.DeepEqual(got, c.wantTestOnly) {
+				t.Errorf("diffTestImports(%v, %v) = %v, want %v", c.all, c.normal, got, c.wantTestOnly)
+			}
+		})
+	}
+}
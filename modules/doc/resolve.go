@@ -0,0 +1,205 @@
+// Copyright 2014 Unknown
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommitDate resolves the commit time for a given commit value of a
+// module so two "commit:" constraints on the same module can be ordered.
+// It is a variable so callers can plug in a real VCS lookup; the default
+// treats all commits as equally recent, so of two commit pins on the same
+// module the one recorded first is kept.
+var CommitDate = func(rootPath, commit string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+// constraint is a single (parent, child, requiredVersion) edge collected
+// while walking the dependency graph for minimum-version selection.
+type constraint struct {
+	parent string
+	typ    int
+	value  string
+}
+
+// Resolver performs a vgo-style minimum-version selection pass over a
+// dependency graph: for every module (RootPath) it collects every version
+// requested anywhere in the tree and keeps the maximum of the requested
+// minimums. A fixed version (tag or commit) always beats a floating
+// branch; two tags are compared by semver; two commits are compared by
+// commit date. Where two requests cannot be ranked -- two branches, two
+// commits of equal date, or a conflict kept in non-strict mode -- the one
+// recorded first is kept, so only then does the result depend on the
+// order in which requirements were recorded.
+//
+// Resolver is safe for concurrent use, since gopmfiles for different
+// packages are typically discovered by several download workers at once.
+type Resolver struct {
+	strict bool
+
+	mu          sync.Mutex
+	constraints map[string][]constraint
+	conflicts   []error
+}
+
+// NewResolver creates a Resolver. When strict is true, Winner returns an
+// error on the first incompatible version conflict for a module; when
+// false, the conflict is recorded and can be retrieved with Conflicts,
+// and Winner picks a best-effort winner instead.
+func NewResolver(strict bool) *Resolver {
+	return &Resolver{
+		strict:      strict,
+		constraints: make(map[string][]constraint),
+	}
+}
+
+// Require records that rootPath was asked for at the given version by
+// parent (the empty string for a top-level requirement).
+func (r *Resolver) Require(parent, rootPath string, typ int, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.constraints[rootPath] = append(r.constraints[rootPath], constraint{parent, typ, value})
+}
+
+// Winner returns the maximum of the minimum versions requested for
+// rootPath so far. It may be called again after more calls to Require;
+// the answer only ever moves towards a higher version.
+func (r *Resolver) Winner(rootPath string) (typ int, value string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cs := r.constraints[rootPath]
+	if len(cs) == 0 {
+		return BRANCH, "", nil
+	}
+
+	winner := cs[0]
+	for _, c := range cs[1:] {
+		next, conflictErr := higher(rootPath, winner, c)
+		if conflictErr != nil {
+			if r.strict {
+				return winner.typ, winner.value, conflictErr
+			}
+			r.conflicts = append(r.conflicts, conflictErr)
+			continue
+		}
+		winner = next
+	}
+	return winner.typ, winner.value, nil
+}
+
+// Conflicts returns the non-fatal version conflicts collected so far.
+// It is only meaningful when the Resolver was created with strict=false.
+func (r *Resolver) Conflicts() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]error(nil), r.conflicts...)
+}
+
+// Modules returns every RootPath a constraint has been recorded for, in a
+// deterministic (sorted) order.
+func (r *Resolver) Modules() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modules := make([]string, 0, len(r.constraints))
+	for rootPath := range r.constraints {
+		modules = append(modules, rootPath)
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+// higher returns whichever of a and b requests the greater minimum
+// version, or an error describing why the two cannot be compared (e.g.
+// two incompatible semver majors).
+func higher(rootPath string, a, b constraint) (constraint, error) {
+	switch {
+	case a.typ == BRANCH && b.typ != BRANCH:
+		return b, nil
+	case b.typ == BRANCH && a.typ != BRANCH:
+		return a, nil
+	case a.typ == BRANCH && b.typ == BRANCH:
+		return a, nil
+	case a.typ == TAG && b.typ == TAG:
+		cmp, err := compareSemver(a.value, b.value)
+		if err != nil {
+			return a, fmt.Errorf("%s: %v", rootPath, err)
+		}
+		if cmp < 0 {
+			return b, nil
+		}
+		return a, nil
+	case a.typ == COMMIT && b.typ == COMMIT:
+		at, aerr := CommitDate(rootPath, a.value)
+		bt, berr := CommitDate(rootPath, b.value)
+		if aerr != nil || berr != nil || at.Equal(bt) {
+			return a, nil
+		}
+		if bt.After(at) {
+			return b, nil
+		}
+		return a, nil
+	default:
+		return a, fmt.Errorf("%s: cannot compare %q and %q", rootPath, a.value, b.value)
+	}
+}
+
+// compareSemver compares two "vMAJOR.MINOR.PATCH"-style tags, returning a
+// positive number when a > b, 0 when equal, and an error when the two
+// have incompatible majors (the classic MVS conflict case).
+func compareSemver(a, b string) (int, error) {
+	av, err := parseSemver(a)
+	if err != nil {
+		return 0, err
+	}
+	bv, err := parseSemver(b)
+	if err != nil {
+		return 0, err
+	}
+	if av[0] != bv[0] {
+		return 0, fmt.Errorf("incompatible versions %s and %s", a, b)
+	}
+	for i := 1; i < len(av); i++ {
+		if av[i] != bv[i] {
+			return av[i] - bv[i], nil
+		}
+	}
+	return 0, nil
+}
+
+// parseSemver parses "v1.2.3" (the "v" prefix is optional) into
+// [major, minor, patch].
+func parseSemver(v string) ([3]int, error) {
+	var out [3]int
+	parts := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3)
+	if len(parts) == 0 {
+		return out, fmt.Errorf("not a semver tag: %q", v)
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.SplitN(p, "-", 2)[0])
+		if err != nil {
+			return out, fmt.Errorf("not a semver tag: %q", v)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
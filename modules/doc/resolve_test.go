@@ -0,0 +1,132 @@
+// Copyright 2014 Unknown
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import "testing"
+
+func TestResolverWinnerBranchLosesToFixedVersion(t *testing.T) {
+	r := NewResolver(false)
+	r.Require("", "github.com/a/b", BRANCH, "")
+	r.Require("", "github.com/a/b", TAG, "v1.2.0")
+
+	typ, value, err := r.Winner("github.com/a/b")
+	if err != nil {
+		t.Fatalf("Winner returned error: %v", err)
+	}
+	if typ != TAG || value != "v1.2.0" {
+		t.Fatalf("got (%d, %q), want (%d, %q)", typ, value, TAG, "v1.2.0")
+	}
+}
+
+func TestResolverWinnerPicksHigherSemver(t *testing.T) {
+	r := NewResolver(false)
+	r.Require("", "github.com/a/b", TAG, "v1.2.0")
+	r.Require("", "github.com/a/b", TAG, "v1.5.1")
+
+	_, value, err := r.Winner("github.com/a/b")
+	if err != nil {
+		t.Fatalf("Winner returned error: %v", err)
+	}
+	if value != "v1.5.1" {
+		t.Fatalf("got %q, want %q", value, "v1.5.1")
+	}
+}
+
+func TestResolverWinnerIncompatibleMajorsConflict(t *testing.T) {
+	r := NewResolver(true)
+	r.Require("", "github.com/a/b", TAG, "v1.0.0")
+	r.Require("", "github.com/a/b", TAG, "v2.0.0")
+
+	if _, _, err := r.Winner("github.com/a/b"); err == nil {
+		t.Fatal("expected a conflict error for incompatible majors, got nil")
+	}
+}
+
+func TestResolverNonStrictRecordsConflictAndPicksBestEffort(t *testing.T) {
+	r := NewResolver(false)
+	r.Require("", "github.com/a/b", TAG, "v1.0.0")
+	r.Require("", "github.com/a/b", TAG, "v2.0.0")
+
+	if _, _, err := r.Winner("github.com/a/b"); err != nil {
+		t.Fatalf("non-strict Winner should not return an error, got %v", err)
+	}
+	if len(r.Conflicts()) != 1 {
+		t.Fatalf("got %d conflicts, want 1", len(r.Conflicts()))
+	}
+}
+
+func TestResolverWinnerNoRequirementsDefaultsToBranch(t *testing.T) {
+	r := NewResolver(false)
+	typ, value, err := r.Winner("github.com/never/required")
+	if err != nil {
+		t.Fatalf("Winner returned error: %v", err)
+	}
+	if typ != BRANCH || value != "" {
+		t.Fatalf("got (%d, %q), want (%d, %q)", typ, value, BRANCH, "")
+	}
+}
+
+func TestResolverModulesSorted(t *testing.T) {
+	r := NewResolver(false)
+	r.Require("", "github.com/z/z", BRANCH, "")
+	r.Require("", "github.com/a/a", BRANCH, "")
+	r.Require("", "github.com/m/m", BRANCH, "")
+
+	got := r.Modules()
+	want := []string{"github.com/a/a", "github.com/m/m", "github.com/z/z"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+		err  bool
+	}{
+		{"v1.2.3", "v1.2.3", 0, false},
+		{"v1.3.0", "v1.2.9", 1, false},
+		{"v1.2.0", "v1.3.0", -1, false},
+		{"1.0.0", "v1.0.0", 0, false},
+		{"v1.0.0", "v2.0.0", 0, true},
+	}
+	for _, c := range cases {
+		cmp, err := compareSemver(c.a, c.b)
+		if c.err {
+			if err == nil {
+				t.Errorf("compareSemver(%q, %q): expected error, got nil", c.a, c.b)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("compareSemver(%q, %q): unexpected error: %v", c.a, c.b, err)
+			continue
+		}
+		switch {
+		case c.want > 0 && cmp <= 0:
+			t.Errorf("compareSemver(%q, %q) = %d, want > 0", c.a, c.b, cmp)
+		case c.want < 0 && cmp >= 0:
+			t.Errorf("compareSemver(%q, %q) = %d, want < 0", c.a, c.b, cmp)
+		case c.want == 0 && cmp != 0:
+			t.Errorf("compareSemver(%q, %q) = %d, want 0", c.a, c.b, cmp)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 Unknown
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// insecureSchemes are the plaintext schemes CheckRemoteScheme rejects
+// outright unless the caller opted into '--insecure', for the rare case
+// of a literal scheme-prefixed path (e.g. a VCS URL passed directly on
+// the command line).
+var insecureSchemes = []string{"http://", "git://", "svn://"}
+
+var (
+	clientMu     sync.Mutex
+	sharedClient = HTTPClient(false)
+)
+
+// SetInsecure configures the package-wide HTTP client returned by Client,
+// which CheckRemoteScheme uses for its remote-path probe, so '--insecure'
+// only needs to be threaded through once per 'gopm get' invocation. The
+// archive downloads behind n.Download do not use this client. Call it
+// once, before any concurrent downloading starts.
+func SetInsecure(insecure bool) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	sharedClient = HTTPClient(insecure)
+}
+
+// Client returns the HTTP client configured by the most recent call to
+// SetInsecure (plain TLS verification by default). CheckRemoteScheme
+// uses it; the archive-download codepath behind n.Download does not, so
+// '--insecure' has no effect on self-signed or plaintext archive fetches.
+func Client() *http.Client {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	return sharedClient
+}
+
+// wellKnownHosts are import-path hosts gopm already talks to over a VCS
+// protocol it controls (HTTPS for github.com et al.), so CheckRemoteScheme
+// does not need to probe them itself.
+var wellKnownHosts = []string{"github.com/", "bitbucket.org/", "launchpad.net/", "golang.org/", "gopkg.in/"}
+
+// CheckRemoteScheme rejects a plaintext custom import path or VCS URL
+// outright, then -- for a custom (non-well-known-host) import path, the
+// case gopm resolves via an HTTP(S) "go-import" meta tag lookup rather
+// than a known VCS endpoint -- actually dials the host using HTTPClient
+// so a plaintext redirect or a self-signed certificate is rejected by
+// default instead of silently trusted. Both checks are skipped when
+// insecure is true.
+func CheckRemoteScheme(importPath string, insecure bool) error {
+	if insecure {
+		return nil
+	}
+
+	for _, scheme := range insecureSchemes {
+		if strings.HasPrefix(importPath, scheme) {
+			return fmt.Errorf("refusing to fetch %q over %s; pass --insecure to allow it", importPath, strings.TrimSuffix(scheme, "://"))
+		}
+	}
+
+	for _, host := range wellKnownHosts {
+		if strings.HasPrefix(importPath, host) {
+			return nil
+		}
+	}
+
+	resp, err := Client().Get("https://" + importPath + "?go-get=1")
+	if err != nil {
+		return fmt.Errorf("refusing custom import path %q: %v; pass --insecure to allow it", importPath, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// HTTPClient returns the http.Client used to resolve custom import paths:
+// by default it refuses self-signed or otherwise invalid TLS certificates
+// and redirects to non-HTTPS URLs, only accepting them when insecure is
+// true.
+func HTTPClient(insecure bool) *http.Client {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+		},
+	}
+	if !insecure {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing plaintext redirect to %s", req.URL)
+			}
+			return nil
+		}
+	}
+	return client
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Unknown
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckRemoteSchemeRejectsPlaintextPrefix(t *testing.T) {
+	for _, importPath := range []string{
+		"http://github.com/a/b",
+		"git://github.com/a/b",
+		"svn://github.com/a/b",
+	} {
+		if err := CheckRemoteScheme(importPath, false); err == nil {
+			t.Errorf("CheckRemoteScheme(%q, false) = nil, want an error", importPath)
+		}
+	}
+}
+
+func TestCheckRemoteSchemeInsecureAllowsEverything(t *testing.T) {
+	for _, importPath := range []string{
+		"http://github.com/a/b",
+		"this.is.a.custom.domain/pkg",
+	} {
+		if err := CheckRemoteScheme(importPath, true); err != nil {
+			t.Errorf("CheckRemoteScheme(%q, true) = %v, want nil", importPath, err)
+		}
+	}
+}
+
+func TestCheckRemoteSchemeSkipsWellKnownHosts(t *testing.T) {
+	for _, importPath := range []string{
+		"github.com/a/b",
+		"bitbucket.org/a/b",
+		"launchpad.net/a/b",
+		"golang.org/x/tools",
+		"gopkg.in/yaml.v2",
+	} {
+		if err := CheckRemoteScheme(importPath, false); err != nil {
+			t.Errorf("CheckRemoteScheme(%q, false) = %v, want nil (well-known host, no network probe)", importPath, err)
+		}
+	}
+}
+
+func TestHTTPClientHonoursInsecureFlag(t *testing.T) {
+	for _, insecure := range []bool{false, true} {
+		transport, ok := HTTPClient(insecure).Transport.(*http.Transport)
+		if !ok || transport.TLSClientConfig.InsecureSkipVerify != insecure {
+			t.Fatalf("HTTPClient(%v) should configure a transport with InsecureSkipVerify=%v", insecure, insecure)
+		}
+	}
+}
+
+func TestSetInsecureUpdatesSharedClient(t *testing.T) {
+	defer SetInsecure(false)
+
+	SetInsecure(true)
+	transport, ok := Client().Transport.(*http.Transport)
+	if !ok || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("Client() should reflect SetInsecure(true)")
+	}
+
+	SetInsecure(false)
+	transport, ok = Client().Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("Client() should reflect SetInsecure(false)")
+	}
+}
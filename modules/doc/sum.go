@@ -0,0 +1,167 @@
+// Copyright 2014 Unknown
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SumDB is an in-memory view of a gopm.sum file: one recorded
+// "rootPath version h1:hash" line per module version, modeled on the
+// dirhash scheme behind the Go command's own go.sum. It is safe for
+// concurrent use, since several download workers can finish at the same
+// time.
+type SumDB struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]string // "rootPath version" -> "h1:hash"
+	dirty   bool
+}
+
+// LoadSumDB reads path if it exists, or returns an empty SumDB ready to
+// be populated and saved to that path.
+func LoadSumDB(path string) (*SumDB, error) {
+	db := &SumDB{path: path, entries: make(map[string]string)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("gopm.sum: malformed line %q", line)
+		}
+		db.entries[fields[0]+" "+fields[1]] = fields[2]
+	}
+	return db, nil
+}
+
+// Verify hashes dir and compares it against the recorded hash for
+// rootPath at version, if any. A module with no recorded hash yet is not
+// an error: it is simply added, the same way 'go get' extends go.sum the
+// first time it sees a module.
+func (db *SumDB) Verify(rootPath, version, dir string) error {
+	hash, err := HashDir(dir)
+	if err != nil {
+		return err
+	}
+
+	key := rootPath + " " + version
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	want, ok := db.entries[key]
+	if !ok {
+		db.entries[key] = hash
+		db.dirty = true
+		return nil
+	}
+	if want != hash {
+		return fmt.Errorf("checksum mismatch for %s: gopm.sum has %s, computed %s", key, want, hash)
+	}
+	return nil
+}
+
+// Update unconditionally refreshes the recorded hash for rootPath at
+// version to whatever is currently on disk at dir, for 'gopm get
+// --update-sum'.
+func (db *SumDB) Update(rootPath, version, dir string) error {
+	hash, err := HashDir(dir)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries[rootPath+" "+version] = hash
+	db.dirty = true
+	return nil
+}
+
+// Save writes the sum file back to disk if anything changed since it was
+// loaded.
+func (db *SumDB) Save() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.dirty {
+		return nil
+	}
+
+	keys := make([]string, 0, len(db.entries))
+	for k := range db.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s %s\n", k, db.entries[k])
+	}
+	return ioutil.WriteFile(db.path, buf.Bytes(), 0644)
+}
+
+// HashDir computes a dirhash over the sorted list of file paths and
+// contents under dir, in the same "h1:" form as the Go command's own
+// module dirhash, so the scheme is familiar to anyone who has read a
+// go.sum.
+func HashDir(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(h, "%x  %s\n", sum, f)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
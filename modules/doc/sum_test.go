@@ -0,0 +1,159 @@
+// Copyright 2014 Unknown
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package doc
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
+
+func TestHashDirDeterministicAndOrderIndependent(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package a\n")
+	writeTestFile(t, dir, "b.go", "package a\n\nfunc B() {}\n")
+
+	h1, err := HashDir(dir)
+	if err != nil {
+		t.Fatalf("HashDir: %v", err)
+	}
+	h2, err := HashDir(dir)
+	if err != nil {
+		t.Fatalf("HashDir: %v", err)
+	}
+	if h1 != h2 {
+		t.Fatalf("HashDir is not deterministic: %q != %q", h1, h2)
+	}
+	if h1[:3] != "h1:" {
+		t.Fatalf("HashDir result missing h1: prefix: %q", h1)
+	}
+
+	// The same files written in the opposite order must hash the same.
+	other := t.TempDir()
+	writeTestFile(t, other, "b.go", "package a\n\nfunc B() {}\n")
+	writeTestFile(t, other, "a.go", "package a\n")
+	h3, err := HashDir(other)
+	if err != nil {
+		t.Fatalf("HashDir: %v", err)
+	}
+	if h1 != h3 {
+		t.Fatalf("HashDir depends on file creation order: %q != %q", h1, h3)
+	}
+}
+
+func TestHashDirChangesWithContent(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package a\n")
+	h1, err := HashDir(dir)
+	if err != nil {
+		t.Fatalf("HashDir: %v", err)
+	}
+
+	writeTestFile(t, dir, "a.go", "package a\n\nfunc A() {}\n")
+	h2, err := HashDir(dir)
+	if err != nil {
+		t.Fatalf("HashDir: %v", err)
+	}
+	if h1 == h2 {
+		t.Fatal("HashDir did not change when file contents changed")
+	}
+}
+
+func TestSumDBVerifyFirstSeenThenMismatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package a\n")
+
+	db, err := LoadSumDB(filepath.Join(t.TempDir(), "gopm.sum"))
+	if err != nil {
+		t.Fatalf("LoadSumDB: %v", err)
+	}
+
+	if err := db.Verify("github.com/a/b", "v1.0.0", dir); err != nil {
+		t.Fatalf("Verify of a never-before-seen module should record it, got error: %v", err)
+	}
+
+	writeTestFile(t, dir, "a.go", "package a\n\nfunc A() {}\n")
+	if err := db.Verify("github.com/a/b", "v1.0.0", dir); err == nil {
+		t.Fatal("expected a checksum mismatch error after contents changed, got nil")
+	}
+}
+
+func TestSumDBUpdateOverwritesRecordedHash(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package a\n")
+
+	db, err := LoadSumDB(filepath.Join(t.TempDir(), "gopm.sum"))
+	if err != nil {
+		t.Fatalf("LoadSumDB: %v", err)
+	}
+	if err := db.Verify("github.com/a/b", "v1.0.0", dir); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	writeTestFile(t, dir, "a.go", "package a\n\nfunc A() {}\n")
+	if err := db.Update("github.com/a/b", "v1.0.0", dir); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := db.Verify("github.com/a/b", "v1.0.0", dir); err != nil {
+		t.Fatalf("Verify after Update should pass, got: %v", err)
+	}
+}
+
+func TestSumDBSaveAndLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.go", "package a\n")
+
+	sumPath := filepath.Join(t.TempDir(), "gopm.sum")
+	db, err := LoadSumDB(sumPath)
+	if err != nil {
+		t.Fatalf("LoadSumDB: %v", err)
+	}
+	if err := db.Verify("github.com/a/b", "v1.0.0", dir); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := db.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	reloaded, err := LoadSumDB(sumPath)
+	if err != nil {
+		t.Fatalf("LoadSumDB (reload): %v", err)
+	}
+	if err := reloaded.Verify("github.com/a/b", "v1.0.0", dir); err != nil {
+		t.Fatalf("Verify after reload should pass, got: %v", err)
+	}
+}
+
+func TestLoadSumDBMissingFileIsNotAnError(t *testing.T) {
+	_, err := LoadSumDB(filepath.Join(t.TempDir(), "does-not-exist.sum"))
+	if err != nil {
+		t.Fatalf("LoadSumDB of a missing file should succeed, got: %v", err)
+	}
+}
+
+func TestLoadSumDBMalformedLine(t *testing.T) {
+	sumPath := filepath.Join(t.TempDir(), "gopm.sum")
+	writeTestFile(t, filepath.Dir(sumPath), filepath.Base(sumPath), "github.com/a/b only-two-fields\n")
+	if _, err := LoadSumDB(sumPath); err == nil {
+		t.Fatal("expected an error for a malformed gopm.sum line, got nil")
+	}
+}